@@ -3,17 +3,41 @@ package headlines
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"index/suffixarray"
 	"io"
+	"math"
 	"math/rand"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // delim is the delimter used to separate tokens.
 const delim = " "
 
+// chainMagic identifies a stream produced by (*Chain).Save.
+var chainMagic = [4]byte{'H', 'D', 'L', 'N'}
+
+// chainVersion is the current version of the binary format written by
+// Save. It is stored in the stream so that future versions of Save and
+// Load can evolve the format without breaking old persisted chains.
+const chainVersion = 5
+
+// Tokenizer kinds identify, in a Chain stream, which of the Tokenizer
+// implementations in this package was in use when the Chain was saved,
+// so that Load can reconstruct an equivalent Tokenizer. A custom
+// Tokenizer supplied via WithTokenizer cannot be named this way; see
+// writeTokenizer.
+const (
+	tokenizerKindRune = iota
+	tokenizerKindRegex
+	tokenizerKindWordsOnly
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -31,36 +55,59 @@ func init() {
 // To map indexes to the actual tokens Indexes are used.
 //
 type Chain struct {
-	// TODO(e-dard): There are way better ways to store the transitions and
-	// representation. One day get around to improving these.
-
 	// Stores the state space—every key is a token (prefix) and the
-	// value associated with that key are indexes of all of the possible
-	// tokens (suffixes) that can follow.
-	//
-	// chain also implicitly stores the state transition structure. Each
-	// suffix index is duplicated in the slice according to how many
-	// times it is found adjacent to the prefix in the corpus. Therefore
-	// transition from a prefix to the next state can be achieved by
-	// uniformly drawing a value in [0, n) where n is the size of the
-	// index slice.
-	chain map[string][]int32
+	// value associated with that key is a weighted set of indexes of
+	// all of the possible tokens (suffixes) that can follow, along with
+	// how many times each one was seen. A transition from a prefix to
+	// the next state is sampled proportionately to these weights.
+	chain map[string]*weighted
 
 	// tokensIdx maps an index from the chain to a token.
 	tokensIdx index
 
-	// Indexes to the first tokens encountered in each example in the
-	// corpus. Used as the first token (starting state) when generating
-	// new examples. As with the values of chain, the indexes are
-	// duplicated according to their frequency as the first token in the
-	// corpus.
-	sp []int32
+	// sp is a weighted set of indexes to the first tokens encountered
+	// in each example in the corpus. Used as the first token (starting
+	// state) when generating new examples; prefixes that begin more
+	// examples carry a proportionately higher weight.
+	sp weighted
 
 	// startingPrefixIdx maps an index from sp to a token.
 	startingPrefixIdx index
 
 	// how large to make each prefix, in terms of number of tokens.
 	prefixLength int
+
+	// maxOrder is non-zero for a Chain created with NewChainWithBackoff,
+	// and is the highest prefix order considered during generation. A
+	// Chain created with NewChain leaves this at zero and only ever
+	// looks at prefixLength-token prefixes.
+	maxOrder int
+
+	// backoffChain stores, for each order from 1 to maxOrder, a mapping
+	// from prefix to the suffixes that followed it in the corpus. It is
+	// only populated when maxOrder is non-zero.
+	backoffChain map[int]map[string]*weighted
+
+	// backoffAlpha weights higher-order backoff matches more heavily
+	// than lower-order ones: a candidate found at order o is weighted
+	// by alpha^(maxOrder-o). A value of 0 disables weighting, in which
+	// case generation uses strict backoff and always prefers the
+	// highest order with any recorded suffixes.
+	backoffAlpha float64
+
+	// tokenizer splits each line read by Build into tokens. It defaults
+	// to a RuneTokenizer, but can be replaced with WithTokenizer.
+	tokenizer Tokenizer
+
+	// corpus indexes the training data for exact phrase lookup. It is
+	// built during Build; see (*Chain).Corpus.
+	corpus *Corpus
+
+	// plagiarismGuard is the length, in tokens, of a verbatim run from
+	// the training corpus that Generate and GenerateFrom will refuse to
+	// reproduce. A value of 0 (the default) disables the check; see
+	// WithPlagiarismGuard.
+	plagiarismGuard int
 }
 
 // NewChain creates a new Chain.
@@ -69,11 +116,64 @@ type Chain struct {
 // to consider when deciding on the next token in a generated phrase.
 func NewChain(l int) *Chain {
 	return &Chain{
-		chain:        map[string][]int32{},
+		chain:        map[string]*weighted{},
 		prefixLength: l,
+		tokenizer:    RuneTokenizer{},
+	}
+}
+
+// NewChainWithBackoff creates a new Chain that performs Katz-style
+// backoff during Generate: when the full maxOrder-token prefix has no
+// recorded suffix, generation drops the leftmost token of the prefix
+// and retries at the next lower order, all the way down to a single
+// token, before terminating the generated phrase early.
+func NewChainWithBackoff(maxOrder int) *Chain {
+	return &Chain{
+		chain:        map[string]*weighted{},
+		backoffChain: map[int]map[string]*weighted{},
+		prefixLength: maxOrder,
+		maxOrder:     maxOrder,
+		tokenizer:    RuneTokenizer{},
 	}
 }
 
+// WithBackoffAlpha sets the weighting factor used when sampling across
+// backoff orders on a Chain created with NewChainWithBackoff: a
+// candidate found at order o is weighted by alpha^(maxOrder-o), so
+// higher-order (more specific) matches are favoured over lower-order
+// ones rather than a strict highest-order-first cutoff. It returns c so
+// it can be chained onto NewChainWithBackoff.
+func (c *Chain) WithBackoffAlpha(alpha float64) *Chain {
+	c.backoffAlpha = alpha
+	return c
+}
+
+// WithTokenizer replaces the Tokenizer used by Build to split each line
+// of the corpus into tokens. It returns c so it can be chained onto
+// NewChain or NewChainWithBackoff.
+func (c *Chain) WithTokenizer(t Tokenizer) *Chain {
+	c.tokenizer = t
+	return c
+}
+
+// WithPlagiarismGuard enables a novelty check during Generate and
+// GenerateFrom: a candidate suffix is rejected, and a different one
+// sampled in its place, if appending it would extend the sentence into
+// a run of k consecutive tokens that appeared verbatim, in that order,
+// in the training corpus. A value of 0 (the default) disables the
+// check. It returns c so it can be chained onto NewChain or
+// NewChainWithBackoff.
+func (c *Chain) WithPlagiarismGuard(k int) *Chain {
+	c.plagiarismGuard = k
+	return c
+}
+
+// Corpus returns the Corpus indexed from the training data during
+// Build, or nil if Build has not yet been called.
+func (c *Chain) Corpus() *Corpus {
+	return c.corpus
+}
+
 // Build consumes from a reader and first builds an index of all tokens
 // read. Then is re-reads from the reader using the built index to
 // construct a mapping between prefixes and suffixes.
@@ -83,9 +183,9 @@ func NewChain(l int) *Chain {
 func (c *Chain) Build(r io.Reader) error {
 	// Multiplex r over multiple buffers, so that we can have a full
 	// reader left over for building the chain.
-	b1, b2 := &bytes.Buffer{}, &bytes.Buffer{}
-	// All reads from tr will be written to b1 and b2.
-	tr := io.TeeReader(r, io.MultiWriter(b1, b2))
+	b1, b2, b3 := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	// All reads from tr will be written to b1, b2 and b3.
+	tr := io.TeeReader(r, io.MultiWriter(b1, b2, b3))
 
 	// Build tokens Index.
 	if err := c.buildTokenIndex(tr); err != nil {
@@ -97,6 +197,11 @@ func (c *Chain) Build(r io.Reader) error {
 		return err
 	}
 
+	// Build the phrase-lookup Corpus using b3.
+	if err := c.buildCorpus(b3); err != nil {
+		return err
+	}
+
 	// Build chain mapping from buffer.
 	return c.buildChain(b2)
 }
@@ -112,7 +217,7 @@ func (c *Chain) buildTokenIndex(r io.Reader) error {
 			c.tokensIdx.Add(token)
 		}
 	}
-	return processStream(r, processTokens)
+	return c.processStream(r, processTokens)
 }
 
 // buildPrefixIndex builds an index of all starting prefixes, that is,
@@ -130,14 +235,37 @@ func (c *Chain) buildPrefixIndex(r io.Reader) error {
 			c.startingPrefixIdx.Add(prefix)
 		}
 	}
-	return processStream(r, processStartingPrefixes)
+	return c.processStream(r, processStartingPrefixes)
+}
+
+// buildCorpus builds the Corpus used by (*Chain).Corpus for exact
+// phrase lookup, and by the plagiarism guard enabled with
+// WithPlagiarismGuard, by feeding every tokenized example into a
+// corpusBuilder.
+func (c *Chain) buildCorpus(r io.Reader) error {
+	b := &corpusBuilder{}
+	processPhrase := func(tokens []string) {
+		b.addExample(tokens)
+	}
+	if err := c.processStream(r, processPhrase); err != nil {
+		return err
+	}
+	c.corpus = b.build(c.tokenizer)
+	return nil
 }
 
 // buildChain builds up the markov chain mapping by examining each
 // phrase read from the provided reader, tokenizing it, and storing
 // mappings between prefixes (one or more tokens) and the following
 // suffix.
+//
+// A Chain created with NewChainWithBackoff instead builds a mapping per
+// prefix order, so that Generate can back off to shorter prefixes.
 func (c *Chain) buildChain(r io.Reader) error {
+	if c.maxOrder > 0 {
+		return c.buildBackoffChain(r)
+	}
+
 	// store each prefix mapped to the following token.
 	processPhrase := func(tokens []string) {
 		for i := 0; i < len(tokens)-c.prefixLength; i++ {
@@ -150,7 +278,12 @@ func (c *Chain) buildChain(r io.Reader) error {
 				// should not be possible
 				panic("can't find token in Index")
 			}
-			c.chain[prefix] = append(c.chain[prefix], suffixI)
+			w, ok := c.chain[prefix]
+			if !ok {
+				w = &weighted{}
+				c.chain[prefix] = w
+			}
+			w.add(suffixI)
 
 			// is this the start of a line?
 			if i == 0 {
@@ -159,11 +292,64 @@ func (c *Chain) buildChain(r io.Reader) error {
 					//should not be possible
 					panic("can't find starting prefix in Index")
 				}
-				c.sp = append(c.sp, startingPrefixI)
+				c.sp.add(startingPrefixI)
+			}
+		}
+	}
+	return c.processStream(r, processPhrase)
+}
+
+// buildBackoffChain is the NewChainWithBackoff counterpart to buildChain.
+// For every position in a phrase it records a prefix-to-suffix mapping
+// for every order from 1 up to maxOrder, so that Generate can fall back
+// to a shorter prefix when the longest one has no recorded suffix.
+func (c *Chain) buildBackoffChain(r io.Reader) error {
+	processPhrase := func(tokens []string) {
+		for i := 0; i < len(tokens)-1; i++ {
+			// The highest order we can record here is bounded both by
+			// maxOrder and by how many tokens remain after i for a
+			// suffix to follow.
+			order := c.maxOrder
+			if rem := len(tokens) - i - 1; rem < order {
+				order = rem
+			}
+
+			for o := 1; o <= order; o++ {
+				prefix := strings.Join(tokens[i:i+o], delim)
+				suffix := tokens[i+o]
+
+				suffixI := c.tokensIdx.Find(suffix)
+				if suffixI == -1 {
+					// should not be possible
+					panic("can't find token in Index")
+				}
+
+				m, ok := c.backoffChain[o]
+				if !ok {
+					m = map[string]*weighted{}
+					c.backoffChain[o] = m
+				}
+				w, ok := m[prefix]
+				if !ok {
+					w = &weighted{}
+					m[prefix] = w
+				}
+				w.add(suffixI)
+			}
+
+			// is this the start of a line?
+			if i == 0 && len(tokens) > c.maxOrder {
+				prefix := strings.Join(tokens[:c.maxOrder], delim)
+				startingPrefixI := c.startingPrefixIdx.Find(prefix)
+				if startingPrefixI == -1 {
+					//should not be possible
+					panic("can't find starting prefix in Index")
+				}
+				c.sp.add(startingPrefixI)
 			}
 		}
 	}
-	return processStream(r, processPhrase)
+	return c.processStream(r, processPhrase)
 }
 
 // MustGenerate panics if Generate returns an error.
@@ -180,10 +366,8 @@ func (c *Chain) MustGenerate(length int) string {
 func (c *Chain) Generate(l int) (string, error) {
 	// Pick a starting prefix with a probability proportionate to
 	// the frequency by which a phrase starts with it.
-	// This works due to c.sp containing duplicate starting prefixes,
-	// so they're sampled according to their frequency.
-	i := rand.Intn(len(c.sp))
-	prefix := c.startingPrefixIdx.Get(int(c.sp[i]))
+	startingPrefixI := c.sp.sample()
+	prefix := c.startingPrefixIdx.Get(int(startingPrefixI))
 	sentence := strings.Split(prefix, delim)
 
 	if len(sentence) < c.prefixLength {
@@ -191,29 +375,1099 @@ func (c *Chain) Generate(l int) (string, error) {
 	}
 
 	for len(sentence) < l {
-		prefix := sentence[len(sentence)-c.prefixLength:]
-		// All suffix indexes associated with prefix.
-		suffixesI := c.chain[strings.Join(prefix, delim)]
-		if len(suffixesI) == 0 {
+		suffix, ok := c.nextSuffix(sentence)
+		if !ok {
 			break
 		}
+		sentence = append(sentence, suffix)
+	}
+	return strings.Join(sentence, delim), nil
+}
+
+// nextSuffix picks the next token to append to sentence. A Chain
+// created with NewChain looks only at the fixed prefixLength-token
+// prefix. A Chain created with NewChainWithBackoff instead tries
+// progressively shorter prefixes, starting at maxOrder, until one with
+// a recorded suffix is found.
+func (c *Chain) nextSuffix(sentence []string) (string, bool) {
+	if c.maxOrder == 0 {
+		prefix := strings.Join(sentence[len(sentence)-c.prefixLength:], delim)
+		return c.sampleSuffix(sentence, c.chain[prefix])
+	}
+
+	if c.backoffAlpha > 0 {
+		return c.weightedBackoffSuffix(sentence)
+	}
+	return c.strictBackoffSuffix(sentence)
+}
+
+// sampleSuffix draws a suffix from w, excluding any candidate that
+// wouldReproduce would reject. It reports false if w is empty, or if
+// WithPlagiarismGuard rejects every candidate w holds.
+func (c *Chain) sampleSuffix(sentence []string, w *weighted) (string, bool) {
+	if w.empty() {
+		return "", false
+	}
+	suffixI, ok := w.sampleFiltered(func(suffixI int32) bool {
+		return c.wouldReproduce(sentence, suffixI)
+	})
+	if !ok {
+		return "", false
+	}
+	return c.tokensIdx.Get(int(suffixI)), true
+}
+
+// wouldReproduce reports whether appending the token identified by
+// suffixI to sentence would extend it into a run of plagiarismGuard
+// consecutive tokens that appeared verbatim, in that order, in the
+// training corpus. It always reports false when WithPlagiarismGuard has
+// not been set, or before Build has indexed a Corpus.
+func (c *Chain) wouldReproduce(sentence []string, suffixI int32) bool {
+	k := c.plagiarismGuard
+	if k == 0 || c.corpus == nil || len(sentence)+1 < k {
+		return false
+	}
+
+	gram := make([]string, 0, k)
+	gram = append(gram, sentence[len(sentence)+1-k:]...)
+	gram = append(gram, c.tokensIdx.Get(int(suffixI)))
+	return len(c.corpus.LookupPhrase(strings.Join(gram, delim))) > 0
+}
+
+// strictBackoffSuffix implements Katz-style backoff: it tries the
+// longest prefix first and, on finding no recorded (and unguarded)
+// suffixes, drops the leftmost token and retries at the next lower
+// order, terminating only once the unigram order is also empty.
+func (c *Chain) strictBackoffSuffix(sentence []string) (string, bool) {
+	order := c.maxOrder
+	if order > len(sentence) {
+		order = len(sentence)
+	}
+
+	for ; order >= 1; order-- {
+		prefix := strings.Join(sentence[len(sentence)-order:], delim)
+		if suffix, ok := c.sampleSuffix(sentence, c.backoffChain[order][prefix]); ok {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// backoffCandidate is a suffix found at some backoff order, along with
+// the weight it should carry during weightedBackoffSuffix's sampling.
+type backoffCandidate struct {
+	suffix int32
+	weight float64
+}
 
-		// Pick a suffix. Suffixes are duplicated, so the probability
-		// of selection is proportionate to their frequency.
-		i := rand.Intn(len(suffixesI))
-		suffix := c.tokensIdx.Get(int(suffixesI[i]))
+// weightedBackoffSuffix pools suffixes found across every order from 1
+// up to maxOrder, weighting those found at order o by
+// backoffAlpha^(maxOrder-o) so that higher-order (more specific)
+// matches are favoured over lower-order ones, rather than the highest
+// order available winning outright.
+func (c *Chain) weightedBackoffSuffix(sentence []string) (string, bool) {
+	maxOrder := c.maxOrder
+	if maxOrder > len(sentence) {
+		maxOrder = len(sentence)
+	}
+
+	var candidates []backoffCandidate
+	var total float64
+	for order := 1; order <= maxOrder; order++ {
+		prefix := strings.Join(sentence[len(sentence)-order:], delim)
+		w := c.backoffChain[order][prefix]
+		if w.empty() {
+			continue
+		}
+
+		scale := math.Pow(c.backoffAlpha, float64(c.maxOrder-order))
+		for i, suffixI := range w.suffixes {
+			if c.wouldReproduce(sentence, suffixI) {
+				continue
+			}
+			weight := scale * float64(w.weights[i])
+			candidates = append(candidates, backoffCandidate{suffix: suffixI, weight: weight})
+			total += weight
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	r := rand.Float64() * total
+	for _, cand := range candidates {
+		r -= cand.weight
+		if r <= 0 {
+			return c.tokensIdx.Get(int(cand.suffix)), true
+		}
+	}
+	return c.tokensIdx.Get(int(candidates[len(candidates)-1].suffix)), true
+}
+
+// GenerateFrom uses the Markov chain to generate a phrase with a
+// maximum length of l, starting from the caller-supplied seed instead
+// of sampling a random starting prefix from sp.
+//
+// The tail of seed, up to the order the Chain was built with, is
+// joined and looked up directly as a prefix. If seed does not end with
+// an exact prefix seen during training, GenerateFrom falls back to a
+// fuzzy match across the known prefixes and continues from whichever
+// one scores highest, as long as that score clears fuzzyMatchThreshold.
+func (c *Chain) GenerateFrom(seed string, l int) (string, error) {
+	tokens := c.tokenizer.Tokenize(seed)
+	order := c.prefixLength
+	if c.maxOrder > 0 {
+		order = c.maxOrder
+	}
+	if len(tokens) < order {
+		return "", fmt.Errorf("seed must contain at least %d tokens", order)
+	}
+
+	prefixes := c.prefixes()
+	prefix := strings.Join(tokens[len(tokens)-order:], delim)
+	if _, ok := prefixes[prefix]; !ok {
+		match, ok := fuzzyBestMatch(prefix, prefixes)
+		if !ok {
+			return "", fmt.Errorf("no prefix found matching seed %q", seed)
+		}
+		prefix = match
+	}
+
+	// Keep the seed's leading tokens, followed by the prefix (exact or
+	// fuzzy-matched) that stands in for its tail.
+	sentence := append([]string{}, tokens[:len(tokens)-order]...)
+	sentence = append(sentence, strings.Split(prefix, delim)...)
+	for len(sentence) < l {
+		suffix, ok := c.nextSuffix(sentence)
+		if !ok {
+			break
+		}
 		sentence = append(sentence, suffix)
 	}
 	return strings.Join(sentence, delim), nil
 }
 
+// prefixes returns the prefix-to-suffixes mapping that GenerateFrom
+// should match seeds against: the full chain order for a Chain created
+// with NewChainWithBackoff, or the fixed chain otherwise.
+func (c *Chain) prefixes() map[string]*weighted {
+	if c.maxOrder > 0 {
+		return c.backoffChain[c.maxOrder]
+	}
+	return c.chain
+}
+
+// fuzzyMatchThreshold is the minimum fzf-style score a candidate prefix
+// must reach in fuzzyBestMatch to be considered a usable match for a
+// seed that has no exact prefix in the chain.
+const fuzzyMatchThreshold = 1
+
+// fuzzyBestMatch returns whichever key of prefixes scores highest
+// against pattern using fuzzyScore, provided that score clears
+// fuzzyMatchThreshold.
+func fuzzyBestMatch(pattern string, prefixes map[string]*weighted) (string, bool) {
+	best := ""
+	bestScore := -1
+	for prefix := range prefixes {
+		if score := fuzzyScore(pattern, prefix); score > bestScore {
+			bestScore, best = score, prefix
+		}
+	}
+	if bestScore < fuzzyMatchThreshold {
+		return "", false
+	}
+	return best, true
+}
+
+// fuzzyScore computes an fzf-style match score for pattern against s: a
+// single left-to-right pass checks that every rune of pattern appears
+// in s, case-insensitively, in order. Consecutive matches and matches
+// that land on a word boundary earn a bonus, and a gap between a match
+// and the one before it is penalized in proportion to its size, so that
+// "qckbrwn" scores higher against "quick brown" than against an
+// unrelated string of the same length that happens to contain the same
+// runes scattered further apart. fuzzyScore returns -1 if pattern is
+// not a subsequence of s.
+func fuzzyScore(pattern, s string) int {
+	p := []rune(strings.ToLower(pattern))
+	t := []rune(strings.ToLower(s))
+	if len(p) == 0 {
+		return 0
+	}
+
+	const (
+		matchBonus       = 1
+		consecutiveBonus = 4
+		boundaryBonus    = 3
+		gapPenalty       = 1
+	)
+
+	score := 0
+	ti := 0
+	consecutive := false
+	prevMatchEnd := -1
+	for _, pr := range p {
+		matched := false
+		for ; ti < len(t); ti++ {
+			if t[ti] != pr {
+				consecutive = false
+				continue
+			}
+
+			bonus := matchBonus
+			if consecutive {
+				bonus += consecutiveBonus
+			}
+			if ti == 0 || isWordBoundary(t[ti-1]) {
+				bonus += boundaryBonus
+			}
+			score += bonus
+			if prevMatchEnd >= 0 {
+				score -= gapPenalty * (ti - prevMatchEnd)
+			}
+			consecutive = true
+			matched = true
+			prevMatchEnd = ti + 1
+			ti++
+			break
+		}
+		if !matched {
+			return -1
+		}
+	}
+	return score
+}
+
+// isWordBoundary reports whether r separates words, so that a match
+// immediately following it can earn fuzzyScore's boundary bonus.
+func isWordBoundary(r rune) bool {
+	return r == ' ' || r == '-' || r == '_' || r == '\t'
+}
+
+// weighted stores a set of suffix indexes along with how many times
+// each one was seen, rather than duplicating a suffix index once per
+// occurrence. A transition can then be sampled by uniformly drawing a
+// value in [0, total) and walking weights to find which suffix it
+// falls under, which uses a fraction of the memory duplicate indexes
+// would need on skewed, high-frequency prefixes.
+type weighted struct {
+	suffixes []int32
+	weights  []uint32
+	total    uint32
+}
+
+// add records an occurrence of suffix, incrementing its weight if it
+// has been seen before or appending it with a weight of one otherwise.
+func (w *weighted) add(suffix int32) {
+	for i, s := range w.suffixes {
+		if s == suffix {
+			w.weights[i]++
+			w.total++
+			return
+		}
+	}
+	w.suffixes = append(w.suffixes, suffix)
+	w.weights = append(w.weights, 1)
+	w.total++
+}
+
+// empty reports whether w has no recorded suffixes. A nil *weighted is
+// considered empty, so callers can look up a map of *weighted by key
+// without a separate existence check.
+func (w *weighted) empty() bool {
+	return w == nil || w.total == 0
+}
+
+// sample draws a suffix index with probability proportionate to its
+// recorded weight.
+func (w *weighted) sample() int32 {
+	r := uint32(rand.Int63n(int64(w.total)))
+	for i, wt := range w.weights {
+		if r < wt {
+			return w.suffixes[i]
+		}
+		r -= wt
+	}
+	return w.suffixes[len(w.suffixes)-1]
+}
+
+// sampleFiltered is like sample, but skips any suffix for which reject
+// returns true, as though it had never been recorded. It reports false
+// if reject rejects every suffix w holds.
+func (w *weighted) sampleFiltered(reject func(int32) bool) (int32, bool) {
+	var total uint32
+	for i, suffixI := range w.suffixes {
+		if !reject(suffixI) {
+			total += w.weights[i]
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	r := uint32(rand.Int63n(int64(total)))
+	for i, suffixI := range w.suffixes {
+		if reject(suffixI) {
+			continue
+		}
+		wt := w.weights[i]
+		if r < wt {
+			return suffixI, true
+		}
+		r -= wt
+	}
+	return 0, false
+}
+
+// Save writes a compact, versioned binary encoding of c to w, so that it
+// can later be restored with Load instead of being rebuilt from the
+// original corpus.
+//
+// The format is a magic header, a version byte, the prefix length, the
+// tokenizer, the two string tables (tokensIdx and startingPrefixIdx),
+// the starting prefix weights (sp), the chain transitions, the backoff
+// settings, the Corpus built during Build and finally the plagiarism
+// guard length. All integers are written as unsigned varints to keep
+// the encoding compact.
+//
+// Save only knows how to persist the Tokenizer implementations in this
+// package (RuneTokenizer, RegexTokenizer and WordsOnlyTokenizer); it
+// returns an error if c was built with a custom Tokenizer supplied via
+// WithTokenizer.
+func (c *Chain) Save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(chainMagic[:]); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(chainVersion); err != nil {
+		return err
+	}
+
+	if err := writeUvarint(bw, uint64(c.prefixLength)); err != nil {
+		return err
+	}
+	if err := writeTokenizer(bw, c.tokenizer); err != nil {
+		return err
+	}
+	if err := writeIndex(bw, c.tokensIdx); err != nil {
+		return err
+	}
+	if err := writeIndex(bw, c.startingPrefixIdx); err != nil {
+		return err
+	}
+	if err := writeWeighted(bw, &c.sp); err != nil {
+		return err
+	}
+
+	if err := writeChain(bw, c.chain); err != nil {
+		return err
+	}
+
+	if err := writeUvarint(bw, uint64(c.maxOrder)); err != nil {
+		return err
+	}
+	var alphaBits [8]byte
+	binary.BigEndian.PutUint64(alphaBits[:], math.Float64bits(c.backoffAlpha))
+	if _, err := bw.Write(alphaBits[:]); err != nil {
+		return err
+	}
+
+	if err := writeUvarint(bw, uint64(len(c.backoffChain))); err != nil {
+		return err
+	}
+	for order, m := range c.backoffChain {
+		if err := writeUvarint(bw, uint64(order)); err != nil {
+			return err
+		}
+		if err := writeChain(bw, m); err != nil {
+			return err
+		}
+	}
+
+	if err := writeCorpus(bw, c.corpus); err != nil {
+		return err
+	}
+	if err := writeUvarint(bw, uint64(c.plagiarismGuard)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Load restores a Chain previously persisted with Save.
+//
+// Load returns an error if r does not begin with the expected magic
+// header, or if the version of the stream is not supported by this
+// version of the package.
+func Load(r io.Reader) (*Chain, error) {
+	br := bufio.NewReader(r)
+
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != chainMagic {
+		return nil, fmt.Errorf("headlines: not a Chain stream")
+	}
+
+	version, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != chainVersion {
+		return nil, fmt.Errorf("headlines: unsupported Chain version %d", version)
+	}
+
+	prefixLength, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenizer, err := readTokenizer(br)
+	if err != nil {
+		return nil, err
+	}
+
+	tokensIdx, err := readIndex(br)
+	if err != nil {
+		return nil, err
+	}
+
+	startingPrefixIdx, err := readIndex(br)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := readWeighted(br)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := readChain(br)
+	if err != nil {
+		return nil, err
+	}
+
+	maxOrder, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var alphaBits [8]byte
+	if _, err := io.ReadFull(br, alphaBits[:]); err != nil {
+		return nil, err
+	}
+	backoffAlpha := math.Float64frombits(binary.BigEndian.Uint64(alphaBits[:]))
+
+	nOrders, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	backoffChain := make(map[int]map[string]*weighted, nOrders)
+	for i := uint64(0); i < nOrders; i++ {
+		order, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		m, err := readChain(br)
+		if err != nil {
+			return nil, err
+		}
+		backoffChain[int(order)] = m
+	}
+
+	corpus, err := readCorpus(br)
+	if err != nil {
+		return nil, err
+	}
+	if corpus != nil {
+		// A Corpus's tokenizer is always the Chain's tokenizer as of
+		// the Build that produced it; readCorpus doesn't persist a
+		// second copy of it.
+		corpus.tokenizer = tokenizer
+	}
+
+	plagiarismGuard, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Chain{
+		chain:             chain,
+		tokensIdx:         tokensIdx,
+		sp:                sp,
+		startingPrefixIdx: startingPrefixIdx,
+		prefixLength:      int(prefixLength),
+		tokenizer:         tokenizer,
+		maxOrder:          int(maxOrder),
+		backoffChain:      backoffChain,
+		backoffAlpha:      backoffAlpha,
+		corpus:            corpus,
+		plagiarismGuard:   int(plagiarismGuard),
+	}, nil
+}
+
+// writeUvarint writes v to w as an unsigned varint.
+func writeUvarint(w io.ByteWriter, v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	for _, b := range buf[:n] {
+		if err := w.WriteByte(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeString writes s to w as a length-prefixed byte string.
+func writeString(w *bufio.Writer, s string) error {
+	if err := writeUvarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+// writeIndex writes idx to w as a length-prefixed string table.
+func writeIndex(w *bufio.Writer, idx index) error {
+	if err := writeUvarint(w, uint64(len(idx.tokens))); err != nil {
+		return err
+	}
+	for _, token := range idx.tokens {
+		if err := writeString(w, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWeighted writes a weighted set to w as a varint count followed
+// by a (suffix, weight) varint pair per entry.
+func writeWeighted(w *bufio.Writer, wt *weighted) error {
+	if err := writeUvarint(w, uint64(len(wt.suffixes))); err != nil {
+		return err
+	}
+	for i, suffix := range wt.suffixes {
+		if err := writeUvarint(w, uint64(suffix)); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(wt.weights[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChain writes a single order's prefix-to-suffixes mapping to w as
+// a varint count followed by a length-prefixed prefix and its weighted
+// suffix set per entry.
+func writeChain(w *bufio.Writer, m map[string]*weighted) error {
+	if err := writeUvarint(w, uint64(len(m))); err != nil {
+		return err
+	}
+	for prefix, wt := range m {
+		if err := writeString(w, prefix); err != nil {
+			return err
+		}
+		if err := writeWeighted(w, wt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readString reads a length-prefixed byte string written by writeString.
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readIndex reads a string table written by writeIndex.
+func readIndex(r *bufio.Reader) (index, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return index{}, err
+	}
+	tokens := make([]string, n)
+	for i := range tokens {
+		token, err := readString(r)
+		if err != nil {
+			return index{}, err
+		}
+		tokens[i] = token
+	}
+	return index{tokens: tokens}, nil
+}
+
+// readWeighted reads a weighted set written by writeWeighted.
+func readWeighted(r *bufio.Reader) (weighted, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return weighted{}, err
+	}
+	wt := weighted{
+		suffixes: make([]int32, n),
+		weights:  make([]uint32, n),
+	}
+	for i := uint64(0); i < n; i++ {
+		suffix, err := binary.ReadUvarint(r)
+		if err != nil {
+			return weighted{}, err
+		}
+		weight, err := binary.ReadUvarint(r)
+		if err != nil {
+			return weighted{}, err
+		}
+		wt.suffixes[i] = int32(suffix)
+		wt.weights[i] = uint32(weight)
+		wt.total += uint32(weight)
+	}
+	return wt, nil
+}
+
+// readChain reads a single order's prefix-to-suffixes mapping written by
+// writeChain.
+func readChain(r *bufio.Reader) (map[string]*weighted, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*weighted, n)
+	for i := uint64(0); i < n; i++ {
+		prefix, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		wt, err := readWeighted(r)
+		if err != nil {
+			return nil, err
+		}
+		m[prefix] = &wt
+	}
+	return m, nil
+}
+
+// writeTokenizer writes t to w as a kind tag identifying which of this
+// package's Tokenizer implementations t is, followed by that
+// implementation's fields. It returns an error if t is not one of
+// RuneTokenizer, RegexTokenizer or WordsOnlyTokenizer, since there is no
+// general way to persist and later reconstruct a caller-supplied
+// Tokenizer.
+func writeTokenizer(w *bufio.Writer, t Tokenizer) error {
+	switch v := t.(type) {
+	case RuneTokenizer:
+		if err := w.WriteByte(tokenizerKindRune); err != nil {
+			return err
+		}
+		return writeBools(w, v.FoldCase, v.TrimPunct)
+	case RegexTokenizer:
+		if err := w.WriteByte(tokenizerKindRegex); err != nil {
+			return err
+		}
+		return writeString(w, v.Pattern.String())
+	case WordsOnlyTokenizer:
+		if err := w.WriteByte(tokenizerKindWordsOnly); err != nil {
+			return err
+		}
+		return writeTokenizer(w, v.Tokenizer)
+	default:
+		return fmt.Errorf("headlines: Save cannot persist Tokenizer of type %T", t)
+	}
+}
+
+// readTokenizer reads a Tokenizer written by writeTokenizer.
+func readTokenizer(r *bufio.Reader) (Tokenizer, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case tokenizerKindRune:
+		foldCase, trimPunct, err := readBools(r)
+		if err != nil {
+			return nil, err
+		}
+		return RuneTokenizer{FoldCase: foldCase, TrimPunct: trimPunct}, nil
+	case tokenizerKindRegex:
+		pattern, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return RegexTokenizer{Pattern: re}, nil
+	case tokenizerKindWordsOnly:
+		inner, err := readTokenizer(r)
+		if err != nil {
+			return nil, err
+		}
+		return WordsOnlyTokenizer{Tokenizer: inner}, nil
+	default:
+		return nil, fmt.Errorf("headlines: unsupported Tokenizer kind %d in Chain stream", kind)
+	}
+}
+
+// writeBools writes each of bs to w as a single byte.
+func writeBools(w *bufio.Writer, bs ...bool) error {
+	for _, b := range bs {
+		v := byte(0)
+		if b {
+			v = 1
+		}
+		if err := w.WriteByte(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBools reads the two bools written by writeBools for a
+// RuneTokenizer.
+func readBools(r *bufio.Reader) (foldCase, trimPunct bool, err error) {
+	fc, err := r.ReadByte()
+	if err != nil {
+		return false, false, err
+	}
+	tp, err := r.ReadByte()
+	if err != nil {
+		return false, false, err
+	}
+	return fc != 0, tp != 0, nil
+}
+
+// Tokenizer splits a single line of corpus text into tokens. Chain uses
+// it while building, via WithTokenizer, so that callers can plug in
+// domain-specific tokenization (e.g. keeping hashtags or URLs intact)
+// without forking the package.
+type Tokenizer interface {
+	Tokenize(line string) []string
+}
+
+// RuneTokenizer is the Tokenizer used by Chain unless WithTokenizer says
+// otherwise. It operates on []rune rather than bytes, so multi-byte
+// runes are never split apart, and it treats any Unicode whitespace as a
+// separator, so multi-space- or tab-separated corpora tokenize the same
+// way as single-space-separated ones.
+//
+// FoldCase, if true, lower-cases every token. TrimPunct, if true, strips
+// leading and trailing Unicode punctuation from each token, so that
+// "foo," and "foo" are treated as the same token; a token that is
+// nothing but punctuation is dropped entirely.
+type RuneTokenizer struct {
+	FoldCase  bool
+	TrimPunct bool
+}
+
+// Tokenize implements Tokenizer.
+func (t RuneTokenizer) Tokenize(line string) []string {
+	runes := []rune(line)
+
+	var fields []string
+	start := -1
+	for i, r := range runes {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				fields = append(fields, string(runes[start:i]))
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, string(runes[start:]))
+	}
+
+	if !t.TrimPunct && !t.FoldCase {
+		return fields
+	}
+
+	tokens := fields[:0]
+	for _, f := range fields {
+		if t.TrimPunct {
+			f = strings.TrimFunc(f, unicode.IsPunct)
+			if f == "" {
+				continue
+			}
+		}
+		if t.FoldCase {
+			f = strings.ToLower(f)
+		}
+		tokens = append(tokens, f)
+	}
+	return tokens
+}
+
+// RegexTokenizer tokenizes a line by extracting every non-overlapping
+// match of Pattern, rather than splitting on whitespace. This suits
+// tokens that RuneTokenizer would otherwise split apart, such as
+// hashtags or URLs.
+type RegexTokenizer struct {
+	Pattern *regexp.Regexp
+}
+
+// Tokenize implements Tokenizer.
+func (t RegexTokenizer) Tokenize(line string) []string {
+	return t.Pattern.FindAllString(line, -1)
+}
+
+// WordsOnlyTokenizer wraps another Tokenizer and drops any token it
+// produces that contains no letter or digit, e.g. punctuation left over
+// from a Tokenizer that doesn't strip it itself.
+type WordsOnlyTokenizer struct {
+	Tokenizer Tokenizer
+}
+
+// Tokenize implements Tokenizer.
+func (t WordsOnlyTokenizer) Tokenize(line string) []string {
+	fields := t.Tokenizer.Tokenize(line)
+
+	tokens := fields[:0]
+	for _, f := range fields {
+		if isWord(f) {
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
+
+// isWord reports whether s contains at least one letter or digit.
+func isWord(s string) bool {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// corpusExampleSep separates examples (phrases) in a Corpus's
+// canonicalized buffer, and corpusTokenSep separates tokens within a
+// single example. Both are single bytes outside of any Tokenizer's
+// normal output, so a match against either can only ever be a genuine
+// token or example boundary.
+const (
+	corpusExampleSep = "\x00"
+	corpusTokenSep   = "\n"
+)
+
+// Occurrence is a single position at which a phrase looked up with
+// (*Corpus).LookupPhrase appeared in the training data.
+type Occurrence struct {
+	// Example is the index, in encounter order, of the training example
+	// (line) the phrase appeared in.
+	Example int
+	// Token is the index, within that example, of the phrase's first
+	// token.
+	Token int
+}
+
+// corpusToken records where a single token from the training corpus
+// begins in a Corpus's canonicalized buffer, and which example and
+// position within that example it came from.
+type corpusToken struct {
+	offset  int
+	example int
+	token   int
+}
+
+// Corpus indexes every token fed to (*Chain).Build for exact phrase
+// lookup. Tokens are canonicalized into a single buffer, separated by
+// corpusTokenSep within an example and corpusExampleSep between
+// examples, and indexed with a suffixarray.Index so that LookupPhrase
+// runs in time proportional to the length of the phrase rather than the
+// size of the corpus.
+type Corpus struct {
+	buf       []byte
+	index     *suffixarray.Index
+	tokens    []corpusToken // sorted by offset
+	tokenizer Tokenizer
+}
+
+// LookupPhrase returns every position in the training corpus at which s
+// appeared, tokenized the same way the corpus itself was, as a
+// contiguous, verbatim run of tokens.
+func (c *Corpus) LookupPhrase(s string) []Occurrence {
+	tokens := c.tokenizer.Tokenize(s)
+	if len(tokens) == 0 {
+		return nil
+	}
+	query := []byte(strings.Join(tokens, corpusTokenSep))
+
+	var occurrences []Occurrence
+	for _, offset := range c.index.Lookup(query, -1) {
+		i := sort.Search(len(c.tokens), func(i int) bool {
+			return c.tokens[i].offset >= offset
+		})
+		if i == len(c.tokens) || c.tokens[i].offset != offset {
+			// The match starts part-way through a token, not at a
+			// recorded token boundary.
+			continue
+		}
+		if end := offset + len(query); end < len(c.buf) {
+			if b := c.buf[end]; b != corpusTokenSep[0] && b != corpusExampleSep[0] {
+				// The match is only a prefix of a longer token.
+				continue
+			}
+		}
+
+		occurrences = append(occurrences, Occurrence{
+			Example: c.tokens[i].example,
+			Token:   c.tokens[i].token,
+		})
+	}
+
+	// suffixarray.Index.Lookup returns matches in no particular order;
+	// sort them so that LookupPhrase's result is deterministic.
+	sort.Slice(occurrences, func(i, j int) bool {
+		if occurrences[i].Example != occurrences[j].Example {
+			return occurrences[i].Example < occurrences[j].Example
+		}
+		return occurrences[i].Token < occurrences[j].Token
+	})
+	return occurrences
+}
+
+// corpusBuilder accumulates the canonicalized buffer and per-token
+// position records used to build a Corpus.
+type corpusBuilder struct {
+	buf     bytes.Buffer
+	tokens  []corpusToken
+	example int
+}
+
+// addExample records one training example (phrase) worth of tokens.
+func (b *corpusBuilder) addExample(tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	b.buf.WriteString(corpusExampleSep)
+	for i, token := range tokens {
+		if i > 0 {
+			b.buf.WriteString(corpusTokenSep)
+		}
+		b.tokens = append(b.tokens, corpusToken{
+			offset:  b.buf.Len(),
+			example: b.example,
+			token:   i,
+		})
+		b.buf.WriteString(token)
+	}
+	b.example++
+}
+
+// build finalizes b into a Corpus, ready for LookupPhrase. tok is used
+// to tokenize any phrase later passed to LookupPhrase, so that it is
+// canonicalized the same way the training data was.
+func (b *corpusBuilder) build(tok Tokenizer) *Corpus {
+	b.buf.WriteString(corpusExampleSep)
+	buf := b.buf.Bytes()
+	return &Corpus{
+		buf:       buf,
+		index:     suffixarray.New(buf),
+		tokens:    b.tokens,
+		tokenizer: tok,
+	}
+}
+
+// writeCorpus writes corpus to w as a presence byte followed, if
+// present, by its canonicalized buffer and per-token position records.
+// Its tokenizer and suffixarray.Index are not written: the tokenizer is
+// always the owning Chain's (see readCorpus), and the index can be
+// rebuilt from the buffer alone.
+func writeCorpus(w *bufio.Writer, corpus *Corpus) error {
+	if corpus == nil {
+		return w.WriteByte(0)
+	}
+	if err := w.WriteByte(1); err != nil {
+		return err
+	}
+
+	if err := writeString(w, string(corpus.buf)); err != nil {
+		return err
+	}
+
+	if err := writeUvarint(w, uint64(len(corpus.tokens))); err != nil {
+		return err
+	}
+	for _, tok := range corpus.tokens {
+		if err := writeUvarint(w, uint64(tok.offset)); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(tok.example)); err != nil {
+			return err
+		}
+		if err := writeUvarint(w, uint64(tok.token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCorpus reads a Corpus written by writeCorpus, rebuilding its
+// suffixarray.Index from the restored buffer. It returns a nil Corpus,
+// with no error, if none was present. The returned Corpus's tokenizer
+// is left unset; the caller fills it in from the owning Chain.
+func readCorpus(r *bufio.Reader) (*Corpus, error) {
+	present, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+
+	buf, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]corpusToken, n)
+	for i := range tokens {
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		example, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		token, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		tokens[i] = corpusToken{offset: int(offset), example: int(example), token: int(token)}
+	}
+
+	return &Corpus{
+		buf:    []byte(buf),
+		index:  suffixarray.New([]byte(buf)),
+		tokens: tokens,
+	}, nil
+}
+
 // processStream consumes from a reader, reading the input line by line.
 //
-// Each line is tokenized, but splitting on delim, and each slice of
-// tokens are passed into processTokens.
+// Each line is tokenized using c.tokenizer, and each slice of tokens is
+// passed into processTokens.
 //
 // processStream does not return an error when it encounters io.EOF.
-func processStream(r io.Reader, processTokens func([]string)) error {
+func (c *Chain) processStream(r io.Reader, processTokens func([]string)) error {
 	br := bufio.NewReader(r)
 	for {
 		line, err := br.ReadBytes(byte('\n'))
@@ -222,7 +1476,7 @@ func processStream(r io.Reader, processTokens func([]string)) error {
 		}
 
 		str := strings.TrimSpace(string(line))
-		tokens := strings.Split(str, delim)
+		tokens := c.tokenizer.Tokenize(str)
 
 		processTokens(tokens)
 		if err == io.EOF {
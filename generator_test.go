@@ -1,11 +1,14 @@
 package headlines
 
 import (
+	"bufio"
 	"bytes"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"regexp"
+	"strings"
 
 	"testing"
 )
@@ -77,6 +80,42 @@ func Test_Index_Find(t *testing.T) {
 	}
 }
 
+// Test_Weighted_Sample_Distribution is a chi-squared-style test that
+// weighted.sample draws suffixes with the same distribution as
+// uniformly drawing from an equivalent list with the suffix duplicated
+// once per occurrence, the way Generate sampled before suffixes were
+// deduplicated into counts.
+func Test_Weighted_Sample_Distribution(t *testing.T) {
+	w := &weighted{
+		suffixes: []int32{0, 1, 2},
+		weights:  []uint32{1, 3, 6},
+		total:    10,
+	}
+
+	const trials = 100000
+	counts := map[int32]int{}
+	for i := 0; i < trials; i++ {
+		counts[w.sample()]++
+	}
+
+	chiSquared := 0.0
+	for i, suffix := range w.suffixes {
+		expected := float64(trials) * float64(w.weights[i]) / float64(w.total)
+		observed := float64(counts[suffix])
+		diff := observed - expected
+		chiSquared += diff * diff / expected
+	}
+
+	// Critical value for a chi-squared distribution with 2 degrees of
+	// freedom (3 suffixes) at p = 0.001, so this only fails if the
+	// sampler's distribution has drifted from the recorded weights by
+	// far more than random chance would explain.
+	const criticalValue = 13.82
+	if chiSquared > criticalValue {
+		t.Fatalf("sampled distribution %v diverges from weights %v (chi-squared %v > %v)\n", counts, w.weights, chiSquared, criticalValue)
+	}
+}
+
 func Test_BuildChain(t *testing.T) {
 	c := NewChain(2)
 	data := `the quick brown fox, jumps over the lazy dog.
@@ -102,22 +141,452 @@ foo bar zoo.`
 		t.Fatalf("expected %v, got %v\n", expectedPrefixes, c.startingPrefixIdx.tokens)
 	}
 
-	expectedsp := []int32{1, 0, 0}
+	expectedsp := weighted{suffixes: []int32{1, 0}, weights: []uint32{1, 2}, total: 3}
 	if !reflect.DeepEqual(expectedsp, c.sp) {
 		t.Fatalf("expected %v, got %v\n", expectedsp, c.sp)
 	}
 
-	expectedC := map[string][]int32{
-		"the quick": []int32{1}, "quick brown": []int32{4},
-		"brown fox,": []int32{6, 5}, "fox, jumps": []int32{8},
-		"jumps over": []int32{10}, "over the": []int32{7},
-		"the lazy": []int32{2}, "foo bar": []int32{1, 11},
-		"bar brown": []int32{4},
+	expectedC := map[string]*weighted{
+		"the quick":   {suffixes: []int32{1}, weights: []uint32{1}, total: 1},
+		"quick brown": {suffixes: []int32{4}, weights: []uint32{1}, total: 1},
+		"brown fox,":  {suffixes: []int32{6, 5}, weights: []uint32{1, 1}, total: 2},
+		"fox, jumps":  {suffixes: []int32{8}, weights: []uint32{1}, total: 1},
+		"jumps over":  {suffixes: []int32{10}, weights: []uint32{1}, total: 1},
+		"over the":    {suffixes: []int32{7}, weights: []uint32{1}, total: 1},
+		"the lazy":    {suffixes: []int32{2}, weights: []uint32{1}, total: 1},
+		"foo bar":     {suffixes: []int32{1, 11}, weights: []uint32{1, 1}, total: 2},
+		"bar brown":   {suffixes: []int32{4}, weights: []uint32{1}, total: 1},
 	}
 	if !reflect.DeepEqual(expectedC, c.chain) {
 		t.Fatalf("expected %v, got %v\n", expectedC, c.chain)
 	}
+}
+
+func Test_BuildBackoffChain(t *testing.T) {
+	c := NewChainWithBackoff(2)
+	data := `the quick brown fox, jumps over the lazy dog.
+foo bar brown fox, hello.
+foo bar zoo.`
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedOrder2 := map[string]*weighted{
+		"the quick":   {suffixes: []int32{1}, weights: []uint32{1}, total: 1},
+		"quick brown": {suffixes: []int32{4}, weights: []uint32{1}, total: 1},
+		"brown fox,":  {suffixes: []int32{6, 5}, weights: []uint32{1, 1}, total: 2},
+		"fox, jumps":  {suffixes: []int32{8}, weights: []uint32{1}, total: 1},
+		"jumps over":  {suffixes: []int32{10}, weights: []uint32{1}, total: 1},
+		"over the":    {suffixes: []int32{7}, weights: []uint32{1}, total: 1},
+		"the lazy":    {suffixes: []int32{2}, weights: []uint32{1}, total: 1},
+		"foo bar":     {suffixes: []int32{1, 11}, weights: []uint32{1, 1}, total: 2},
+		"bar brown":   {suffixes: []int32{4}, weights: []uint32{1}, total: 1},
+	}
+	if !reflect.DeepEqual(expectedOrder2, c.backoffChain[2]) {
+		t.Fatalf("expected order 2 %v, got %v\n", expectedOrder2, c.backoffChain[2])
+	}
+
+	expectedOrder1 := map[string]*weighted{
+		"the":   {suffixes: []int32{9, 7}, weights: []uint32{1, 1}, total: 2},
+		"quick": {suffixes: []int32{1}, weights: []uint32{1}, total: 1},
+		"brown": {suffixes: []int32{4}, weights: []uint32{2}, total: 2},
+		"fox,":  {suffixes: []int32{6, 5}, weights: []uint32{1, 1}, total: 2},
+		"jumps": {suffixes: []int32{8}, weights: []uint32{1}, total: 1},
+		"over":  {suffixes: []int32{10}, weights: []uint32{1}, total: 1},
+		"lazy":  {suffixes: []int32{2}, weights: []uint32{1}, total: 1},
+		"foo":   {suffixes: []int32{0}, weights: []uint32{2}, total: 2},
+		"bar":   {suffixes: []int32{1, 11}, weights: []uint32{1, 1}, total: 2},
+	}
+	if !reflect.DeepEqual(expectedOrder1, c.backoffChain[1]) {
+		t.Fatalf("expected order 1 %v, got %v\n", expectedOrder1, c.backoffChain[1])
+	}
+}
+
+func Test_Generate_Backoff(t *testing.T) {
+	c := NewChainWithBackoff(3).WithBackoffAlpha(2)
+	data := `the quick brown fox
+a brown fox jumps`
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
 
+	// "quick brown fox" is never followed by another token, so a sentence
+	// started from "the quick brown" can only go on past "fox" if
+	// Generate backs off to the shorter "brown fox" or "fox" prefix,
+	// both of which are followed by "jumps" in the second example.
+	for i := 0; i < 20; i++ {
+		sentence, err := c.Generate(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sentence != "the quick brown fox jumps" && sentence != "a brown fox jumps" {
+			t.Fatalf("expected Generate to back off past %q, got %q\n", "the quick brown fox", sentence)
+		}
+	}
+}
+
+func Test_FuzzyScore(t *testing.T) {
+	examples := []struct {
+		pattern, s string
+		wantMatch  bool
+	}{
+		{pattern: "quick brown", s: "quick brown", wantMatch: true},
+		{pattern: "qckbrwn", s: "quick brown", wantMatch: true},
+		{pattern: "zzz", s: "quick brown", wantMatch: false},
+	}
+
+	for _, ex := range examples {
+		score := fuzzyScore(ex.pattern, ex.s)
+		if got := score != -1; got != ex.wantMatch {
+			t.Fatalf("fuzzyScore(%q, %q) = %d, wantMatch %v\n", ex.pattern, ex.s, score, ex.wantMatch)
+		}
+	}
+
+	// A pattern that matches consecutively and on a word boundary should
+	// score higher than one that only matches scattered, non-boundary
+	// runes.
+	if s1, s2 := fuzzyScore("quick", "quick brown"), fuzzyScore("quick", "xqxuxixcxk"); s1 <= s2 {
+		t.Fatalf("expected %q to score higher against %q than %q, got %d <= %d\n", "quick", "quick brown", "xqxuxixcxk", s1, s2)
+	}
+
+	// Two candidates with the same bonus-earning hits (neither
+	// consecutive, both with "a" on a word boundary) should still score
+	// differently if the gap between their matched runes differs: the
+	// tighter gap must score higher.
+	if s1, s2 := fuzzyScore("ab", "axb"), fuzzyScore("ab", "axxxb"); s1 <= s2 {
+		t.Fatalf("expected %q to score higher against %q than %q, got %d <= %d\n", "ab", "axb", "axxxb", s1, s2)
+	}
+}
+
+func Test_RuneTokenizer_Tokenize(t *testing.T) {
+	examples := []struct {
+		name string
+		tok  RuneTokenizer
+		line string
+		want []string
+	}{
+		{
+			name: "unicode whitespace",
+			tok:  RuneTokenizer{},
+			line: "héllo\twörld  fôo",
+			want: []string{"héllo", "wörld", "fôo"},
+		},
+		{
+			name: "trim punct",
+			tok:  RuneTokenizer{TrimPunct: true},
+			line: "quick, brown! fox,,",
+			want: []string{"quick", "brown", "fox"},
+		},
+		{
+			name: "fold case",
+			tok:  RuneTokenizer{FoldCase: true},
+			line: "QUICK Brown",
+			want: []string{"quick", "brown"},
+		},
+	}
+
+	for _, ex := range examples {
+		if got := ex.tok.Tokenize(ex.line); !reflect.DeepEqual(ex.want, got) {
+			t.Fatalf("%s: expected %v, got %v\n", ex.name, ex.want, got)
+		}
+	}
+}
+
+func Test_RegexTokenizer_Tokenize(t *testing.T) {
+	tok := RegexTokenizer{Pattern: regexp.MustCompile(`#\w+|\w+`)}
+	got := tok.Tokenize("hello #world foo")
+	want := []string{"hello", "#world", "foo"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected %v, got %v\n", want, got)
+	}
+}
+
+func Test_WordsOnlyTokenizer_Tokenize(t *testing.T) {
+	tok := WordsOnlyTokenizer{Tokenizer: RuneTokenizer{}}
+	got := tok.Tokenize("foo , bar !!")
+	want := []string{"foo", "bar"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected %v, got %v\n", want, got)
+	}
+}
+
+func Test_Tokenizer_SaveLoad(t *testing.T) {
+	examples := []Tokenizer{
+		RuneTokenizer{},
+		RuneTokenizer{TrimPunct: true, FoldCase: true},
+		RegexTokenizer{Pattern: regexp.MustCompile(`#\w+|\w+`)},
+		WordsOnlyTokenizer{Tokenizer: RegexTokenizer{Pattern: regexp.MustCompile(`\w+`)}},
+	}
+
+	for _, tok := range examples {
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		if err := writeTokenizer(bw, tok); err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readTokenizer(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tok, got) {
+			t.Fatalf("expected %#v, got %#v\n", tok, got)
+		}
+	}
+}
+
+func Test_Chain_Build_WithTokenizer(t *testing.T) {
+	c := NewChain(2).WithTokenizer(RuneTokenizer{TrimPunct: true, FoldCase: true})
+	data := "The Quick,  Brown\tfox, jumps over the lazy dog."
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Splitting with strings.Split(str, " ") would produce an empty token
+	// between "Quick," and "Brown" (two spaces), and "Quick," and "fox,"
+	// would keep their trailing commas and casing as separate tokens from
+	// "quick" and "fox". RuneTokenizer's whitespace splitting fixes the
+	// first, and TrimPunct and FoldCase fix the second.
+	for _, tok := range []string{"", "quick,", "Quick,", "fox,"} {
+		if i := c.tokensIdx.Find(tok); i != -1 {
+			t.Fatalf("expected %q not to be a token, found at %d\n", tok, i)
+		}
+	}
+	for _, tok := range []string{"quick", "brown", "fox"} {
+		if i := c.tokensIdx.Find(tok); i == -1 {
+			t.Fatalf("expected %q to be a token\n", tok)
+		}
+	}
+}
+
+func Test_GenerateFrom(t *testing.T) {
+	c := NewChain(2)
+	data := `the quick brown fox, jumps over the lazy dog.
+foo bar brown fox, hello.
+foo bar zoo.`
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	sentence, err := c.GenerateFrom("the quick", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sentence, "the quick") {
+		t.Fatalf("expected sentence to start with %q, got %q\n", "the quick", sentence)
+	}
+
+	// "fo bar" isn't in the corpus verbatim, but it's a close fuzzy
+	// match for the "foo bar" prefix, so it should still generate.
+	if _, err := c.GenerateFrom("fo bar", 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GenerateFrom("nothing like this corpus", 6); err == nil {
+		t.Fatal("expected an error for a seed with no matching prefix")
+	}
+}
+
+func Test_Chain_SaveLoad(t *testing.T) {
+	c := NewChain(2).WithTokenizer(RuneTokenizer{TrimPunct: true, FoldCase: true})
+	data := `the quick brown fox, jumps over the lazy dog.
+foo bar brown fox, hello.
+foo bar zoo.`
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.tokensIdx, got.tokensIdx) {
+		t.Fatalf("expected tokensIdx %v, got %v\n", c.tokensIdx, got.tokensIdx)
+	}
+	if !reflect.DeepEqual(c.startingPrefixIdx, got.startingPrefixIdx) {
+		t.Fatalf("expected startingPrefixIdx %v, got %v\n", c.startingPrefixIdx, got.startingPrefixIdx)
+	}
+	if !reflect.DeepEqual(c.sp, got.sp) {
+		t.Fatalf("expected sp %v, got %v\n", c.sp, got.sp)
+	}
+	if !reflect.DeepEqual(c.chain, got.chain) {
+		t.Fatalf("expected chain %v, got %v\n", c.chain, got.chain)
+	}
+	if c.prefixLength != got.prefixLength {
+		t.Fatalf("expected prefixLength %v, got %v\n", c.prefixLength, got.prefixLength)
+	}
+	if !reflect.DeepEqual(c.tokenizer, got.tokenizer) {
+		t.Fatalf("expected tokenizer %#v, got %#v\n", c.tokenizer, got.tokenizer)
+	}
+
+	// A loaded Chain must be just as usable as the one that produced
+	// it, not just a snapshot of its data.
+	if _, err := got.GenerateFrom("the quick", 6); err != nil {
+		t.Fatalf("GenerateFrom on a loaded Chain: %v", err)
+	}
+}
+
+func Test_Chain_SaveLoad_Backoff(t *testing.T) {
+	c := NewChainWithBackoff(2).WithBackoffAlpha(1.5)
+	data := `the quick brown fox, jumps over the lazy dog.
+foo bar brown fox, hello.
+foo bar zoo.`
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.backoffChain, got.backoffChain) {
+		t.Fatalf("expected backoffChain %v, got %v\n", c.backoffChain, got.backoffChain)
+	}
+	if c.maxOrder != got.maxOrder {
+		t.Fatalf("expected maxOrder %v, got %v\n", c.maxOrder, got.maxOrder)
+	}
+	if c.backoffAlpha != got.backoffAlpha {
+		t.Fatalf("expected backoffAlpha %v, got %v\n", c.backoffAlpha, got.backoffAlpha)
+	}
+}
+
+func Test_Chain_SaveLoad_CorpusAndPlagiarismGuard(t *testing.T) {
+	c := NewChain(1).WithPlagiarismGuard(3)
+	data := "the quick brown fox.\nthe lazy dog sleeps."
+
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.plagiarismGuard != c.plagiarismGuard {
+		t.Fatalf("expected plagiarismGuard %v, got %v\n", c.plagiarismGuard, got.plagiarismGuard)
+	}
+	if got.Corpus() == nil {
+		t.Fatal("expected a loaded Chain's Corpus to survive Save/Load, got nil")
+	}
+
+	want := c.Corpus().LookupPhrase("the quick brown")
+	gotOccurrences := got.Corpus().LookupPhrase("the quick brown")
+	if !reflect.DeepEqual(want, gotOccurrences) {
+		t.Fatalf("expected %v, got %v\n", want, gotOccurrences)
+	}
+
+	// "the quick brown fox." is the entire first example verbatim, so a
+	// loaded Chain's plagiarism guard must still refuse to reproduce it.
+	for i := 0; i < 20; i++ {
+		sentence, err := got.GenerateFrom("the quick brown", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sentence == "the quick brown fox." {
+			t.Fatalf("expected plagiarism guard to survive Load, got verbatim reproduction %q", sentence)
+		}
+	}
+}
+
+func Test_Chain_Load_BadMagic(t *testing.T) {
+	if _, err := Load(bytes.NewBufferString("not a chain")); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func Test_Corpus_LookupPhrase(t *testing.T) {
+	c := NewChain(2)
+	data := `the quick brown fox, jumps over the lazy dog.
+foo bar brown fox, hello.
+foo bar zoo.`
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	examples := []struct {
+		name  string
+		query string
+		want  []Occurrence
+	}{
+		{
+			name:  "phrase in one example",
+			query: "the quick brown",
+			want:  []Occurrence{{Example: 0, Token: 0}},
+		},
+		{
+			name:  "phrase shared by two examples",
+			query: "brown fox,",
+			want:  []Occurrence{{Example: 0, Token: 2}, {Example: 1, Token: 2}},
+		},
+		{
+			name:  "single token",
+			query: "foo",
+			want:  []Occurrence{{Example: 1, Token: 0}, {Example: 2, Token: 0}},
+		},
+		{
+			name:  "not a phrase in the corpus",
+			query: "quick fox,",
+			want:  nil,
+		},
+		{
+			name:  "prefix of a token is not a match",
+			query: "fo",
+			want:  nil,
+		},
+	}
+
+	for _, ex := range examples {
+		got := c.Corpus().LookupPhrase(ex.query)
+		if !reflect.DeepEqual(ex.want, got) {
+			t.Fatalf("%s: expected %v, got %v\n", ex.name, ex.want, got)
+		}
+	}
+}
+
+func Test_Generate_PlagiarismGuard(t *testing.T) {
+	c := NewChain(1).WithPlagiarismGuard(3)
+	data := "the quick brown fox.\nthe lazy dog sleeps."
+	if err := c.Build(bytes.NewBufferString(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a guard of 3, "the quick brown" (a verbatim 3-gram from the
+	// corpus) must never appear as a run within a generated sentence.
+	for i := 0; i < 100; i++ {
+		sentence, err := c.Generate(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(sentence, "the quick brown") {
+			t.Fatalf("generated sentence reproduced a training 3-gram verbatim: %q\n", sentence)
+		}
+	}
 }
 
 func benchmark_Build(prefix int, b *testing.B) {